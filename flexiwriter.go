@@ -7,19 +7,60 @@ package flexiwriter
  * Dynamic io.MultiWriter
  * By J. Stuart McMurray
  * Created 20220526
- * Last Modified 20220528
+ * Last Modified 20260726
  */
 
 import (
+	"bytes"
+	"errors"
 	"io"
+	"os"
 	"sync"
+	"time"
 )
 
+// ErrSlowConsumer is sent to a writer's error channel, in place of a write
+// error, when a writer added with AddAsync falls far enough behind that its
+// queue is evicted.
+var ErrSlowConsumer = errors.New("slow consumer evicted")
+
+// ErrWriteTimeout is sent to a writer's error channel, in place of a write
+// error, when a writer added with AddWithTimeout doesn't finish a write
+// before its timeout elapses.
+var ErrWriteTimeout = errors.New("write timed out")
+
+// NopWriteCloser returns an io.WriteCloser with a no-op Close method,
+// wrapping w.  It lets a plain io.Writer opt into the auto-close behavior of
+// AddCloser.
+func NopWriteCloser(w io.Writer) io.WriteCloser { return nopWriteCloser{w} }
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
 /* singleWriter is a single underlying writer in a Writer. */
 type singleWriter struct {
-	l   sync.Mutex
-	ech chan<- error
-	w   io.Writer
+	l      sync.Mutex
+	ech    chan<- error
+	w      io.Writer
+	closer io.Closer /* Non-nil only for writers added with AddCloser. */
+
+	/* The below are only set for writers added with AddAsync. */
+	queue  [][]byte      /* Pending, not-yet-written copies of p. */
+	qlen   int           /* Bytes currently in queue. */
+	qmax   int           /* Max bytes allowed in queue before eviction. */
+	notify chan struct{} /* Signalled when queue gains data or sw is done. */
+	closed bool          /* Set once sw has been removed from its Writer. */
+
+	/* timeout, if nonzero, bounds how long a write to w may take; it's
+	only set for writers added with AddWithTimeout. */
+	timeout time.Duration
+
+	/* The below back Writer.Children and are protected by l. */
+	added        time.Time /* When sw was added to its Writer. */
+	bytesWritten uint64    /* Bytes successfully written to w. */
+	lastErr      error     /* Most recent write error, if any. */
+	qhwm         int       /* Highest qlen has reached. */
 }
 
 // Writer is an io.WriteCloser which writes to multiple sub-writers.
@@ -27,12 +68,43 @@ type Writer struct {
 	l    sync.Mutex
 	ws   map[*singleWriter]struct{}
 	done bool
+
+	/* backlog, if non-nil, holds the most recently written bytes, to be
+	replayed to writers as they're added. */
+	backlog *ringBuffer
+
+	/* spool, if non-nil, is where writes are spooled instead of being
+	sent to w's children; see CoupleWithReader. */
+	spool *spool
+
+	/* The below back Writer.Stats and are protected by l. */
+	totalBytes     uint64
+	totalWrites    uint64
+	evictedError   uint64
+	evictedSlow    uint64
+	evictedTimeout uint64
+	removed        uint64
 }
 
 // New returns a new Writer, ready for use.  The returned writer's Add method
 // must be called to add io.Writers.
 func New() *Writer { return &Writer{ws: make(map[*singleWriter]struct{})} }
 
+// NewWithBacklog is like New, but the returned Writer keeps a ring buffer of
+// the most recent size bytes written to it.  Whenever an io.Writer is added
+// to the returned Writer, with any of its Add methods, the contents of the
+// ring are replayed to it before it starts receiving new writes via Write:
+// synchronously, during the Add call, for Add, AddCloser and AddWithTimeout
+// (bounded by the timeout for the latter), and as the first queued write for
+// AddAsync, so that AddAsync doesn't wait for the replay.  This lets a newly-attached subscriber, such as a
+// tail-follower or a WebSocket client, catch up on recent output.
+func NewWithBacklog(size int) *Writer {
+	return &Writer{
+		ws:      make(map[*singleWriter]struct{}),
+		backlog: newRingBuffer(size),
+	}
+}
+
 // Add adds an io.Witer to w, such that all writes to w will be written to the
 // added io.Writer.  The first error encountered when writing to the io.Writer
 // will be sent to the returned channel and the io.Writer will be removed from
@@ -44,10 +116,158 @@ func (w *Writer) Add(child io.Writer) (remove func(), err <-chan error) {
 	defer w.l.Unlock()
 	ech := make(chan error, 1)
 	sw := &singleWriter{
-		ech: ech,
-		w:   child,
+		ech:   ech,
+		w:     child,
+		added: time.Now(),
+	}
+	w.attach(sw)
+	return func() {
+		w.l.Lock()
+		defer w.l.Unlock()
+		w.delete(sw, nil)
+	}, ech
+}
+
+// AddCloser is like Add, but child is also closed, once, whenever it's
+// removed from w: by an explicit call to the returned remove function, by
+// Writer.Close, or by eviction after a failed write.  If no other error
+// preceded it, any error returned by Close is sent on the returned channel.
+// Add, unlike AddCloser, never closes child, even if it happens to
+// implement io.Closer; wrap a plain io.Writer with NopWriteCloser to opt it
+// into AddCloser's auto-close behavior.
+func (w *Writer) AddCloser(child io.WriteCloser) (remove func(), err <-chan error) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	ech := make(chan error, 1)
+	sw := &singleWriter{
+		ech:    ech,
+		w:      child,
+		closer: child,
+		added:  time.Now(),
+	}
+	w.attach(sw)
+	return func() {
+		w.l.Lock()
+		defer w.l.Unlock()
+		w.delete(sw, nil)
+	}, ech
+}
+
+// AddWithTimeout is like Add, but each write to child is bounded by d.  If
+// child.Write hasn't returned by the time d elapses, child is evicted as
+// though its Write had failed, and ErrWriteTimeout, rather than a write
+// error, is sent on the returned channel; the abandoned write is not waited
+// for.
+func (w *Writer) AddWithTimeout(
+	child io.Writer,
+	d time.Duration,
+) (remove func(), err <-chan error) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	ech := make(chan error, 1)
+	sw := &singleWriter{
+		ech:     ech,
+		w:       child,
+		timeout: d,
+		added:   time.Now(),
+	}
+	w.attach(sw)
+	return func() {
+		w.l.Lock()
+		defer w.l.Unlock()
+		w.delete(sw, nil)
+	}, ech
+}
+
+/* attach replays w's backlog, if any, to sw.w and, if that succeeds, adds sw
+to w.ws and returns true.  If the replay fails, the error is sent on sw.ech
+and sw.ech is closed, sw is never added to w.ws, and attach returns false.
+Like fanOut, the replay is bounded by sw.timeout if it's set, and for a
+writer added with AddAsync, the replay is queued for drainAsync rather than
+written synchronously, so a stuck sw.w holds up attach, and with it the Add
+call and w.l, for at most sw.timeout, or not at all for an AddAsync writer.
+w.l must be held during the call to attach. */
+func (w *Writer) attach(sw *singleWriter) bool {
+	if nil != w.backlog {
+		if b := w.backlog.Bytes(); 0 != len(b) {
+			var err error
+			switch {
+			case nil != sw.notify:
+				err = w.queueBacklog(sw, b)
+			case 0 != sw.timeout:
+				err = writeWithTimeout(sw.w, b, sw.timeout)
+			default:
+				_, err = sw.w.Write(b)
+			}
+			if nil != err {
+				sw.ech <- err
+				close(sw.ech)
+				sw.ech = nil
+				return false
+			}
+		}
 	}
 	w.ws[sw] = struct{}{}
+	return true
+}
+
+/* writeWithTimeout writes b to w, bounding the write by d; if d elapses
+before the write finishes, writeWithTimeout returns ErrWriteTimeout without
+waiting for the abandoned write. */
+func writeWithTimeout(w io.Writer, b []byte, d time.Duration) error {
+	cp := append([]byte(nil), b...)
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write(cp)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(d):
+		return ErrWriteTimeout
+	}
+}
+
+/* queueBacklog queues b as sw's first pending write, for drainAsync to
+write once it's started.  sw isn't yet reachable from w.ws or drainAsync,
+so, unlike enqueue, queueBacklog doesn't need sw.l.  If b would grow sw's
+queue past sw.qmax, queueBacklog returns ErrSlowConsumer instead of
+queueing it. */
+func (w *Writer) queueBacklog(sw *singleWriter, b []byte) error {
+	if len(b) > sw.qmax {
+		return ErrSlowConsumer
+	}
+	cp := append([]byte(nil), b...)
+	sw.queue = append(sw.queue, cp)
+	sw.qlen += len(cp)
+	sw.qhwm = sw.qlen
+	return nil
+}
+
+// AddAsync is like Add, but writes to child are queued and handed to child
+// by a dedicated goroutine, rather than written synchronously during Write.
+// This keeps a slow child from blocking writes to w's other children.  If
+// child's queue grows beyond bufBytes before it can be drained, child is
+// evicted as though its Write had failed, and ErrSlowConsumer, rather than a
+// write error, is sent on the returned channel.
+func (w *Writer) AddAsync(
+	child io.Writer,
+	bufBytes int,
+) (remove func(), err <-chan error) {
+	w.l.Lock()
+	defer w.l.Unlock()
+	ech := make(chan error, 1)
+	sw := &singleWriter{
+		ech:    ech,
+		w:      child,
+		qmax:   bufBytes,
+		notify: make(chan struct{}, 1),
+		added:  time.Now(),
+	}
+	if w.attach(sw) {
+		go w.drainAsync(sw)
+	}
 	return func() {
 		w.l.Lock()
 		defer w.l.Unlock()
@@ -57,29 +277,143 @@ func (w *Writer) Add(child io.Writer) (remove func(), err <-chan error) {
 
 // Write writes to all of the io.Writers Add'd to w.  If a write encounters
 // an error, the error is sent to the channel returned from Add and that
-// io.Writer is removed from w.  The error returned from Write is always nil.
-// Write blocks and blocks other calls to w's methods until all the underlying
-// writing has finished.  The returned int is always len(p).
+// io.Writer is removed from w.  The error returned from Write is always nil,
+// unless w is coupled to a reader via CoupleWithReader and spooling p to a
+// temp file fails.  Write blocks and blocks other calls to w's methods until
+// all of the synchronous underlying writing has finished; writers added with
+// AddAsync are instead handed a copy of p to write on their own time.  The
+// returned int is always len(p).
 func (w *Writer) Write(p []byte) (int, error) {
 	w.l.Lock()
 	defer w.l.Unlock()
+	w.totalWrites++
+	w.totalBytes += uint64(len(p))
+	if nil != w.backlog {
+		w.backlog.Write(p)
+	}
+	if nil != w.spool {
+		if err := w.spool.write(p); nil != err {
+			return len(p), err
+		}
+		return len(p), nil
+	}
+	w.fanOut(p)
+	return len(p), nil
+}
+
+/* fanOut writes p to every writer currently attached to w: synchronously,
+bounded by its timeout if it has one, for writers added with Add, AddCloser
+and AddWithTimeout, and via its queue for writers added with AddAsync.  w.l
+must be held during the call to fanOut. */
+func (w *Writer) fanOut(p []byte) {
+	/* failed collects writers which failed during this fan-out, so they
+	can be deleted one at a time afterwards, rather than racing each
+	other to mutate w.ws from multiple goroutines. */
+	type failure struct {
+		sw  *singleWriter
+		err error
+	}
+	var (
+		fl     sync.Mutex
+		failed []failure
+	)
 	var wg sync.WaitGroup
 	for cw := range w.ws {
+		if nil != cw.notify {
+			w.enqueue(cw, p)
+			continue
+		}
 		wg.Add(1)
 		go func(sw *singleWriter) {
 			defer wg.Done()
-			if _, err := sw.w.Write(p); nil != err {
-				w.delete(sw, err)
+			var err error
+			if 0 == sw.timeout {
+				_, err = sw.w.Write(p)
+			} else {
+				err = writeWithTimeout(sw.w, p, sw.timeout)
+			}
+			sw.l.Lock()
+			if nil == err {
+				sw.bytesWritten += uint64(len(p))
+			} else {
+				sw.lastErr = err
+			}
+			sw.l.Unlock()
+			if nil != err {
+				fl.Lock()
+				failed = append(failed, failure{sw, err})
+				fl.Unlock()
 			}
 		}(cw)
 	}
 	wg.Wait()
+	for _, f := range failed {
+		w.delete(f.sw, f.err)
+	}
+}
 
-	return len(p), nil
+/* enqueue queues a copy of p for later writing to sw.w by sw's drainAsync
+goroutine.  If doing so would grow sw's queue past sw.qmax bytes, sw is
+evicted with ErrSlowConsumer instead.  w.l must be held during the call to
+enqueue. */
+func (w *Writer) enqueue(sw *singleWriter, p []byte) {
+	sw.l.Lock()
+	if sw.qlen+len(p) > sw.qmax {
+		sw.l.Unlock()
+		w.delete(sw, ErrSlowConsumer)
+		return
+	}
+	cp := append([]byte(nil), p...)
+	sw.queue = append(sw.queue, cp)
+	sw.qlen += len(cp)
+	if sw.qlen > sw.qhwm {
+		sw.qhwm = sw.qlen
+	}
+	sw.l.Unlock()
+	select {
+	case sw.notify <- struct{}{}:
+	default:
+	}
+}
+
+/* drainAsync writes sw's queued writes to sw.w, in order, until sw is
+removed from w or a write to sw.w fails.  It's only started for writers
+added with AddAsync. */
+func (w *Writer) drainAsync(sw *singleWriter) {
+	for {
+		sw.l.Lock()
+		for 0 == len(sw.queue) && !sw.closed {
+			sw.l.Unlock()
+			<-sw.notify
+			sw.l.Lock()
+		}
+		if sw.closed {
+			sw.l.Unlock()
+			return
+		}
+		p := sw.queue[0]
+		sw.queue = sw.queue[1:]
+		sw.qlen -= len(p)
+		sw.l.Unlock()
+		_, err := sw.w.Write(p)
+		sw.l.Lock()
+		if nil == err {
+			sw.bytesWritten += uint64(len(p))
+		} else {
+			sw.lastErr = err
+		}
+		sw.l.Unlock()
+		if nil != err {
+			w.l.Lock()
+			w.delete(sw, err)
+			w.l.Unlock()
+			return
+		}
+	}
 }
 
-// Close prevents further writes to w and closes all of its underlying writers
-// which implement io.Closer.  It always returns nil.
+// Close prevents further writes to w and closes all of its underlying
+// writers which were added with AddCloser.  It always returns nil.
 func (w *Writer) Close() error {
 	w.l.Lock()
 	defer w.l.Unlock()
@@ -88,24 +422,332 @@ func (w *Writer) Close() error {
 		return nil
 	}
 	for cw := range w.ws {
-		if c, ok := cw.w.(io.Closer); ok {
-			c.Close()
-		}
 		w.delete(cw, nil)
 	}
 	return nil
 }
 
-/* delete sends err to c.ech if it's the first error sent, closes c.ech, and
-removes c from w.  w.l must be held during the call to delete.  w.l must be
-held during the call to delete. */
+/* delete sends err to sw.ech if it's the first error sent, closes sw.ech,
+and removes sw from w.  If sw was added with AddCloser, its child is closed
+and, absent a more interesting err, any error from Close takes err's place.
+If sw is an async writer, its queue is discarded and its drainAsync
+goroutine is woken so it can exit.  The Writer-level eviction counters
+backing Stats are updated according to err, once per sw.  w.l must be held
+during the call to delete. */
 func (w *Writer) delete(sw *singleWriter, err error) {
 	sw.l.Lock()
 	defer sw.l.Unlock()
-	delete(w.ws, sw)
+	if _, ok := w.ws[sw]; ok {
+		delete(w.ws, sw)
+		switch {
+		case nil == err:
+			w.removed++
+		case errors.Is(err, ErrSlowConsumer):
+			w.evictedSlow++
+		case errors.Is(err, ErrWriteTimeout):
+			w.evictedTimeout++
+		default:
+			w.evictedError++
+		}
+	}
+	if !sw.closed {
+		sw.closed = true
+		sw.queue = nil
+		sw.qlen = 0
+		if nil != sw.notify {
+			select {
+			case sw.notify <- struct{}{}:
+			default:
+			}
+		}
+		if nil != sw.closer {
+			if cerr := sw.closer.Close(); nil == err {
+				err = cerr
+			}
+		}
+	}
 	if nil != sw.ech {
 		sw.ech <- err
 		close(sw.ech)
 		sw.ech = nil
 	}
 }
+
+// Stats is a point-in-time snapshot of a Writer's activity, as returned by
+// Writer.Stats.
+type Stats struct {
+	BytesWritten uint64 // Total bytes passed to Write.
+	Writes       uint64 // Total calls to Write.
+	Active       int    // Number of currently-attached children.
+
+	EvictedError   uint64 // Children evicted after a failed write.
+	EvictedSlow    uint64 // Children evicted by AddAsync's slow-consumer check.
+	EvictedTimeout uint64 // Children evicted by AddWithTimeout.
+	Removed        uint64 // Children removed via their remove func or Close.
+}
+
+// Stats returns a snapshot of w's activity.  It's safe to call concurrently
+// with Write and the Add family of methods.
+func (w *Writer) Stats() Stats {
+	w.l.Lock()
+	defer w.l.Unlock()
+	return Stats{
+		BytesWritten:   w.totalBytes,
+		Writes:         w.totalWrites,
+		Active:         len(w.ws),
+		EvictedError:   w.evictedError,
+		EvictedSlow:    w.evictedSlow,
+		EvictedTimeout: w.evictedTimeout,
+		Removed:        w.removed,
+	}
+}
+
+// ChildInfo is an opaque, point-in-time snapshot of one of a Writer's
+// children, as returned by Writer.Children.
+type ChildInfo struct {
+	bytesWritten uint64
+	lastErr      error
+	added        time.Time
+	queueDepth   int
+	queueHWM     int
+}
+
+// BytesWritten returns the number of bytes successfully written to this
+// child.
+func (ci ChildInfo) BytesWritten() uint64 { return ci.bytesWritten }
+
+// LastError returns the most recent error encountered writing to this child,
+// or nil if no write to it has failed.
+func (ci ChildInfo) LastError() error { return ci.lastErr }
+
+// Added returns the time this child was added to its Writer.
+func (ci ChildInfo) Added() time.Time { return ci.added }
+
+// QueueDepth returns the number of bytes currently queued for this child.
+// It's always 0 for children not added with AddAsync.
+func (ci ChildInfo) QueueDepth() int { return ci.queueDepth }
+
+// QueueHighWaterMark returns the largest QueueDepth this child has reached.
+// It's always 0 for children not added with AddAsync.
+func (ci ChildInfo) QueueHighWaterMark() int { return ci.queueHWM }
+
+// Children returns a snapshot of per-child counters for every io.Writer
+// currently attached to w, in no particular order.  It's safe to call
+// concurrently with Write and the Add family of methods.
+func (w *Writer) Children() []ChildInfo {
+	w.l.Lock()
+	defer w.l.Unlock()
+	cis := make([]ChildInfo, 0, len(w.ws))
+	for sw := range w.ws {
+		sw.l.Lock()
+		cis = append(cis, ChildInfo{
+			bytesWritten: sw.bytesWritten,
+			lastErr:      sw.lastErr,
+			added:        sw.added,
+			queueDepth:   sw.qlen,
+			queueHWM:     sw.qhwm,
+		})
+		sw.l.Unlock()
+	}
+	return cis
+}
+
+// Flusher flushes the bytes spooled by CoupleWithReader to w's children.
+// Flush is idempotent, and safe to call concurrently with Write.
+type Flusher interface {
+	Flush() error
+}
+
+// defaultMaxSpoolBytes is the default value of MaxSpoolBytes: the number of
+// bytes a spool set up by CoupleWithReader holds in memory before it spills
+// to a temp file.
+const defaultMaxSpoolBytes = 1 << 20 /* 1MiB */
+
+// CoupleWithReaderOption configures the spool set up by CoupleWithReader.
+type CoupleWithReaderOption func(*spool)
+
+// MaxSpoolBytes overrides the default number of bytes (1MiB) CoupleWithReader
+// holds in memory before spilling the spool, and all subsequent spooled
+// writes, to a temp file.  A non-positive n disables the temp file and
+// leaves the spool unbounded in memory; this is not recommended for spools
+// which may hold an attacker-controlled amount of data.
+func MaxSpoolBytes(n int) CoupleWithReaderOption {
+	return func(sp *spool) { sp.maxMem = n }
+}
+
+// CoupleWithReader returns an io.Reader wrapping r, and a Flusher.  Until
+// the returned reader is drained, i.e. until a call to its Read returns a
+// non-nil error, writes submitted to w are spooled rather than fanned out to
+// w's children: in memory up to MaxSpoolBytes bytes (1MiB by default), and
+// to a temp file beyond that.  Once the reader is drained, the spooled
+// bytes are written, in order, to every child currently attached to w, and
+// writes to w thereafter pass through as usual.  The returned Flusher's
+// Flush method does the same thing early; it's a no-op if called again,
+// including after the reader has already triggered it.
+//
+// This is meant for proxies built atop flexiwriter: replying to a peer
+// before its request body has been fully read can deadlock the peer, so the
+// reply is held back until the body's reader is drained.  Since the body
+// being held back can be arbitrarily large, opts should be used to tune or
+// disable the temp-file spill for the expected workload.
+func CoupleWithReader(r io.Reader, w *Writer, opts ...CoupleWithReaderOption) (io.Reader, Flusher) {
+	sp := &spool{w: w, maxMem: defaultMaxSpoolBytes}
+	for _, opt := range opts {
+		opt(sp)
+	}
+	w.l.Lock()
+	w.spool = sp
+	w.l.Unlock()
+	return &coupledReader{r: r, sp: sp}, sp
+}
+
+/* spool holds writes made to w while it's coupled to a reader, until
+Flush is called.  All of its fields are protected by w.l. */
+type spool struct {
+	w       *Writer
+	buf     bytes.Buffer
+	file    *os.File /* Non-nil once buf has spilled to a temp file. */
+	maxMem  int      /* Bytes to hold in buf before spilling to file. */
+	flushed bool
+}
+
+/* write appends p to s, spilling s's contents, and p, to a temp file once
+doing so would grow s past s.maxMem bytes in memory.  w.l must be held
+during the call to write. */
+func (s *spool) write(p []byte) error {
+	if nil != s.file {
+		_, err := s.file.Write(p)
+		return err
+	}
+	if 0 >= s.maxMem || s.buf.Len()+len(p) <= s.maxMem {
+		s.buf.Write(p)
+		return nil
+	}
+	f, err := os.CreateTemp("", "flexiwriter-spool-*")
+	if nil != err {
+		return err
+	}
+	if _, err := f.Write(s.buf.Bytes()); nil != err {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if _, err := f.Write(p); nil != err {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	s.buf.Reset()
+	s.file = f
+	return nil
+}
+
+// Flush sends s's buffered bytes to s.w's current children and lets
+// subsequent writes to s.w pass through normally.  It's a no-op after its
+// first call.  s.w.l is held for the whole of Flush, so the spooled bytes
+// are always delivered before any Write racing with Flush.
+func (s *spool) Flush() error {
+	s.w.l.Lock()
+	defer s.w.l.Unlock()
+	if s.flushed {
+		return nil
+	}
+	s.flushed = true
+	if s.w.spool == s {
+		s.w.spool = nil
+	}
+	if nil != s.file {
+		defer s.file.Close()
+		defer os.Remove(s.file.Name())
+		return s.flushFile()
+	}
+	if 0 != s.buf.Len() {
+		s.w.fanOut(s.buf.Bytes())
+	}
+	return nil
+}
+
+/* spoolReadSize is the size of the chunks spool.flushFile reads from its
+temp file, so flushing a large spool doesn't require reading it back into
+memory all at once. */
+const spoolReadSize = 64 * 1024
+
+/* flushFile reads s.file from the start and fans its contents out to s.w's
+children, in spoolReadSize chunks.  s.w.l must be held during the call to
+flushFile. */
+func (s *spool) flushFile() error {
+	if _, err := s.file.Seek(0, io.SeekStart); nil != err {
+		return err
+	}
+	buf := make([]byte, spoolReadSize)
+	for {
+		n, err := s.file.Read(buf)
+		if 0 != n {
+			s.w.fanOut(buf[:n])
+		}
+		if nil != err {
+			if io.EOF == err {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+/* coupledReader wraps an io.Reader, flushing sp the first time a Read
+returns a non-nil error. */
+type coupledReader struct {
+	r  io.Reader
+	sp *spool
+}
+
+func (cr *coupledReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	if nil != err {
+		cr.sp.Flush()
+	}
+	return n, err
+}
+
+/* ringBuffer is a fixed-size circular buffer holding the most recently
+written bytes, for replay to writers added after the fact. */
+type ringBuffer struct {
+	buf   []byte
+	pos   int /* Index at which the next byte will be written. */
+	total int /* Bytes ever written, capped at len(buf). */
+}
+
+/* newRingBuffer returns a ringBuffer which holds up to size bytes. */
+func newRingBuffer(size int) *ringBuffer { return &ringBuffer{buf: make([]byte, size)} }
+
+/* Write appends p to r, overwriting the oldest buffered bytes as needed. */
+func (r *ringBuffer) Write(p []byte) {
+	if 0 == len(r.buf) || 0 == len(p) {
+		return
+	}
+	if len(p) >= len(r.buf) {
+		copy(r.buf, p[len(p)-len(r.buf):])
+		r.pos = 0
+		r.total = len(r.buf)
+		return
+	}
+	n := copy(r.buf[r.pos:], p)
+	if n < len(p) {
+		copy(r.buf, p[n:])
+	}
+	r.pos = (r.pos + len(p)) % len(r.buf)
+	if r.total += len(p); r.total > len(r.buf) {
+		r.total = len(r.buf)
+	}
+}
+
+/* Bytes returns a copy of r's currently buffered bytes, oldest first. */
+func (r *ringBuffer) Bytes() []byte {
+	if r.total < len(r.buf) {
+		return append([]byte(nil), r.buf[:r.total]...)
+	}
+	out := make([]byte, len(r.buf))
+	n := copy(out, r.buf[r.pos:])
+	copy(out[n:], r.buf[:r.pos])
+	return out
+}
@@ -5,12 +5,17 @@ package flexiwriter
  * Tests for flexiwriter
  * By J. Stuart McMurray
  * Created 20220526
- * Last Modified 20220528
+ * Last Modified 20260726
  */
 
 import (
 	"bytes"
+	"errors"
 	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -72,3 +77,530 @@ func TestFlexiwriter(t *testing.T) {
 		t.Fatalf("No receive from e1")
 	}
 }
+
+func TestWriterAddAsync(t *testing.T) {
+	pr, pw := io.Pipe()
+	fw := New()
+	_, ech := fw.AddAsync(pw, 1024)
+	have := []byte(time.Now().String())
+	if _, err := fw.Write(have); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+	got := make([]byte, len(have))
+	if _, err := io.ReadFull(pr, got); nil != err {
+		t.Fatalf("Read: %s", err)
+	}
+	if !bytes.Equal(got, have) {
+		t.Fatalf("Read: got:%q want:%q", got, have)
+	}
+	select {
+	case err, ok := <-ech:
+		if !ok {
+			t.Fatalf("Channel closed early")
+		}
+		t.Fatalf("Unexpected error: %s", err)
+	default:
+	}
+}
+
+func TestWriterAddAsyncSlowConsumer(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	fw := New()
+	_, ech := fw.AddAsync(pw, 1)
+	if _, err := fw.Write([]byte("hello")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+	select {
+	case err, ok := <-ech:
+		if !ok {
+			t.Fatalf("Channel closed without an error")
+		}
+		if !errors.Is(err, ErrSlowConsumer) {
+			t.Fatalf("Got:%s want:%s", err, ErrSlowConsumer)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No eviction after a second")
+	}
+}
+
+func TestNewWithBacklog(t *testing.T) {
+	fw := NewWithBacklog(5)
+	if _, err := fw.Write([]byte("hello world")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+	var buf bytes.Buffer
+	if _, err := fw.Write([]byte("!")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+	if _, ech := fw.Add(&buf); nil == ech {
+		t.Fatalf("Add returned a nil channel")
+	}
+	if got, want := buf.String(), "orld!"; got != want {
+		t.Fatalf("Replayed backlog got:%q want:%q", got, want)
+	}
+	buf.Reset()
+	if _, err := fw.Write([]byte("x")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+	if got, want := buf.String(), "x"; got != want {
+		t.Fatalf("Post-attach write got:%q want:%q", got, want)
+	}
+}
+
+/* blockingWriter blocks every Write until unblock is closed, then records a
+copy of p on got, to simulate a sink that's stuck for a while. */
+type blockingWriter struct {
+	unblock chan struct{}
+	got     chan []byte
+}
+
+func (b blockingWriter) Write(p []byte) (int, error) {
+	<-b.unblock
+	b.got <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestNewWithBacklogAddWithTimeoutDoesNotBlock(t *testing.T) {
+	fw := NewWithBacklog(16)
+	if _, err := fw.Write([]byte("backlog")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	stuck := blockingWriter{unblock: unblock, got: make(chan []byte, 1)}
+
+	addDone := make(chan struct{})
+	var ech <-chan error
+	go func() {
+		_, ech = fw.AddWithTimeout(stuck, time.Millisecond)
+		close(addDone)
+	}()
+	select {
+	case <-addDone:
+	case <-time.After(time.Second):
+		t.Fatalf("AddWithTimeout blocked on a stuck child's backlog replay")
+	}
+
+	var buf bytes.Buffer
+	fw.Add(&buf)
+	writeDone := make(chan struct{})
+	go func() {
+		fw.Write([]byte("more"))
+		close(writeDone)
+	}()
+	select {
+	case <-writeDone:
+	case <-time.After(time.Second):
+		t.Fatalf("Write blocked by a stuck AddWithTimeout child's backlog replay")
+	}
+	if got, want := buf.String(), "backlogmore"; got != want {
+		t.Fatalf("got:%q want:%q", got, want)
+	}
+
+	select {
+	case err, ok := <-ech:
+		if !ok {
+			t.Fatalf("channel closed without an error")
+		}
+		if !errors.Is(err, ErrWriteTimeout) {
+			t.Fatalf("got:%s want:%s", err, ErrWriteTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no eviction after a second")
+	}
+}
+
+func TestNewWithBacklogAddAsyncDoesNotBlock(t *testing.T) {
+	fw := NewWithBacklog(16)
+	if _, err := fw.Write([]byte("backlog")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+
+	unblock := make(chan struct{})
+	stuck := blockingWriter{unblock: unblock, got: make(chan []byte, 2)}
+
+	addDone := make(chan struct{})
+	go func() {
+		fw.AddAsync(stuck, 1024)
+		close(addDone)
+	}()
+	select {
+	case <-addDone:
+	case <-time.After(time.Second):
+		t.Fatalf("AddAsync blocked on a stuck child's backlog replay")
+	}
+
+	var buf bytes.Buffer
+	fw.Add(&buf)
+	writeDone := make(chan struct{})
+	go func() {
+		fw.Write([]byte("more"))
+		close(writeDone)
+	}()
+	select {
+	case <-writeDone:
+	case <-time.After(time.Second):
+		t.Fatalf("Write blocked by a stuck AddAsync child's backlog replay")
+	}
+	if got, want := buf.String(), "backlogmore"; got != want {
+		t.Fatalf("got:%q want:%q", got, want)
+	}
+
+	close(unblock)
+	for _, want := range []string{"backlog", "more"} {
+		select {
+		case got := <-stuck.got:
+			if string(got) != want {
+				t.Fatalf("drained write got:%q want:%q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("queued backlog write never drained")
+		}
+	}
+}
+
+type slowWriter struct{ d time.Duration }
+
+func (s slowWriter) Write(p []byte) (int, error) {
+	time.Sleep(s.d)
+	return len(p), nil
+}
+
+func TestWriterAddWithTimeout(t *testing.T) {
+	fw := New()
+	_, ech := fw.AddWithTimeout(slowWriter{d: time.Second}, time.Millisecond)
+	if _, err := fw.Write([]byte("hi")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+	select {
+	case err, ok := <-ech:
+		if !ok {
+			t.Fatalf("Channel closed without an error")
+		}
+		if !errors.Is(err, ErrWriteTimeout) {
+			t.Fatalf("Got:%s want:%s", err, ErrWriteTimeout)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("No eviction after a second")
+	}
+}
+
+type capturingWriter struct {
+	d   time.Duration
+	got chan []byte
+}
+
+func (c *capturingWriter) Write(p []byte) (int, error) {
+	time.Sleep(c.d)
+	c.got <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestWriterAddWithTimeoutDoesNotRetainBuffer(t *testing.T) {
+	cw := &capturingWriter{d: 50 * time.Millisecond, got: make(chan []byte, 1)}
+	fw := New()
+	fw.AddWithTimeout(cw, time.Millisecond)
+	p := []byte("original")
+	if _, err := fw.Write(p); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+	for i := range p { /* Mutate p right after Write returns. */
+		p[i] = 'X'
+	}
+	select {
+	case got := <-cw.got:
+		if want := "original"; string(got) != want {
+			t.Fatalf(
+				"Abandoned write got mutated bytes "+
+					"got:%q want:%q",
+				got,
+				want,
+			)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Child never received a write")
+	}
+}
+
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+	err    error
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return c.err
+}
+
+func TestWriterAddCloser(t *testing.T) {
+	fw := New()
+	cr := &closeRecorder{}
+	remove, ech := fw.AddCloser(cr)
+	if _, err := fw.Write([]byte("hi")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+	remove()
+	if !cr.closed {
+		t.Fatalf("child was not closed on remove")
+	}
+	select {
+	case err, ok := <-ech:
+		if !ok {
+			t.Fatalf("channel closed without a value")
+		}
+		if nil != err {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	default:
+		t.Fatalf("no receive from err channel")
+	}
+}
+
+func TestWriterAddCloserCloseError(t *testing.T) {
+	fw := New()
+	cerr := errors.New("close failed")
+	cr := &closeRecorder{err: cerr}
+	remove, ech := fw.AddCloser(cr)
+	remove()
+	select {
+	case err, ok := <-ech:
+		if !ok {
+			t.Fatalf("channel closed without a value")
+		}
+		if !errors.Is(err, cerr) {
+			t.Fatalf("got:%s want:%s", err, cerr)
+		}
+	default:
+		t.Fatalf("no receive from err channel")
+	}
+}
+
+func TestWriterAddNeverCloses(t *testing.T) {
+	fw := New()
+	cr := &closeRecorder{}
+	_, ech := fw.Add(cr)
+	fw.Close()
+	if cr.closed {
+		t.Fatalf("Add'd writer was closed by Writer.Close")
+	}
+	<-ech
+}
+
+func TestNopWriteCloser(t *testing.T) {
+	var buf bytes.Buffer
+	fw := New()
+	_, ech := fw.AddCloser(NopWriteCloser(&buf))
+	fw.Close()
+	<-ech
+}
+
+func TestWriterStats(t *testing.T) {
+	fw := New()
+	var buf bytes.Buffer
+	remove, _ := fw.Add(&buf)
+	if _, err := fw.Write([]byte("hello")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+	remove()
+	_, ech := fw.AddAsync(discardWriter{}, 1)
+	if _, err := fw.Write([]byte("xx")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+	<-ech
+
+	st := fw.Stats()
+	if got, want := st.Writes, uint64(2); got != want {
+		t.Errorf("Writes got:%d want:%d", got, want)
+	}
+	if got, want := st.BytesWritten, uint64(7); got != want {
+		t.Errorf("BytesWritten got:%d want:%d", got, want)
+	}
+	if got, want := st.Removed, uint64(1); got != want {
+		t.Errorf("Removed got:%d want:%d", got, want)
+	}
+	if got, want := st.EvictedSlow, uint64(1); got != want {
+		t.Errorf("EvictedSlow got:%d want:%d", got, want)
+	}
+	if got, want := st.Active, 0; got != want {
+		t.Errorf("Active got:%d want:%d", got, want)
+	}
+}
+
+type discardWriter struct{}
+
+func (discardWriter) Write(p []byte) (int, error) { return len(p), nil }
+
+func TestWriterChildren(t *testing.T) {
+	fw := New()
+	var buf bytes.Buffer
+	fw.Add(&buf)
+	if _, err := fw.Write([]byte("hello")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+	cis := fw.Children()
+	if len(cis) != 1 {
+		t.Fatalf("got %d children, want 1", len(cis))
+	}
+	if got, want := cis[0].BytesWritten(), uint64(5); got != want {
+		t.Errorf("BytesWritten got:%d want:%d", got, want)
+	}
+	if nil != cis[0].LastError() {
+		t.Errorf("unexpected LastError: %s", cis[0].LastError())
+	}
+	if cis[0].Added().IsZero() {
+		t.Errorf("Added time is zero")
+	}
+}
+
+func TestCoupleWithReader(t *testing.T) {
+	fw := New()
+	var buf bytes.Buffer
+	fw.Add(&buf)
+
+	body := strings.NewReader("request body")
+	cr, fl := CoupleWithReader(body, fw)
+
+	if _, err := fw.Write([]byte("reply ")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+	if 0 != buf.Len() {
+		t.Fatalf("child got a write before the reader was drained: %q", buf.String())
+	}
+
+	if _, err := io.ReadAll(cr); nil != err {
+		t.Fatalf("ReadAll: %s", err)
+	}
+	if got, want := buf.String(), "reply "; got != want {
+		t.Fatalf("post-drain flush got:%q want:%q", got, want)
+	}
+
+	buf.Reset()
+	if err := fl.Flush(); nil != err {
+		t.Fatalf("second Flush: %s", err)
+	}
+	if 0 != buf.Len() {
+		t.Fatalf("second Flush re-sent spooled bytes: %q", buf.String())
+	}
+
+	if _, err := fw.Write([]byte("more")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+	if got, want := buf.String(), "more"; got != want {
+		t.Fatalf("post-flush write got:%q want:%q", got, want)
+	}
+}
+
+func TestCoupleWithReaderExplicitFlush(t *testing.T) {
+	fw := New()
+	var buf bytes.Buffer
+	fw.Add(&buf)
+
+	pr, pw := io.Pipe()
+	_, fl := CoupleWithReader(pr, fw)
+	defer pw.Close()
+
+	if _, err := fw.Write([]byte("early")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+	if err := fl.Flush(); nil != err {
+		t.Fatalf("Flush: %s", err)
+	}
+	if got, want := buf.String(), "early"; got != want {
+		t.Fatalf("got:%q want:%q", got, want)
+	}
+}
+
+/* delayedWriter is a bytes.Buffer which sleeps before each Write, to widen
+any window in which a racing Write could land out of order. */
+type delayedWriter struct {
+	mu sync.Mutex
+	bytes.Buffer
+	d time.Duration
+}
+
+func (d *delayedWriter) Write(p []byte) (int, error) {
+	time.Sleep(d.d)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.Buffer.Write(p)
+}
+
+func (d *delayedWriter) String() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.Buffer.String()
+}
+
+func TestCoupleWithReaderFlushSerializesWithWrite(t *testing.T) {
+	fw := New()
+	dw := &delayedWriter{d: 50 * time.Millisecond}
+	fw.Add(dw)
+
+	pr, pw := io.Pipe()
+	_, fl := CoupleWithReader(pr, fw)
+	defer pw.Close()
+
+	if _, err := fw.Write([]byte("spooled-")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		time.Sleep(10 * time.Millisecond)
+		if _, err := fw.Write([]byte("after")); nil != err {
+			t.Errorf("Concurrent Write: %s", err)
+		}
+	}()
+	if err := fl.Flush(); nil != err {
+		t.Fatalf("Flush: %s", err)
+	}
+	wg.Wait()
+
+	if got, want := dw.String(), "spooled-after"; got != want {
+		t.Fatalf("got:%q want:%q", got, want)
+	}
+}
+
+func TestCoupleWithReaderSpillsToTempFile(t *testing.T) {
+	fw := New()
+	var buf bytes.Buffer
+	fw.Add(&buf)
+
+	pr, pw := io.Pipe()
+	_, fl := CoupleWithReader(pr, fw, MaxSpoolBytes(4))
+	defer pw.Close()
+
+	if _, err := fw.Write([]byte("hello world")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+	if _, err := fw.Write([]byte("!")); nil != err {
+		t.Fatalf("Write: %s", err)
+	}
+
+	pattern := filepath.Join(os.TempDir(), "flexiwriter-spool-*")
+	matches, err := filepath.Glob(pattern)
+	if nil != err {
+		t.Fatalf("Glob: %s", err)
+	}
+	if 0 == len(matches) {
+		t.Fatalf("no spool temp file found after exceeding MaxSpoolBytes")
+	}
+
+	if err := fl.Flush(); nil != err {
+		t.Fatalf("Flush: %s", err)
+	}
+	if got, want := buf.String(), "hello world!"; got != want {
+		t.Fatalf("got:%q want:%q", got, want)
+	}
+
+	if matches, err = filepath.Glob(pattern); nil != err {
+		t.Fatalf("Glob: %s", err)
+	} else if 0 != len(matches) {
+		t.Fatalf("spool temp file(s) not cleaned up after Flush: %v", matches)
+	}
+}